@@ -7,6 +7,7 @@ package amqp
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
 	"io"
 	"net"
@@ -14,11 +15,13 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 const defaultHeartbeat = 10 * time.Second
 const defaultConnectionTimeout = 30 * time.Second
+const defaultLocale = "en_US"
 
 const (
 	readWriteTimeout         = time.Second * 30
@@ -95,6 +98,26 @@ type Config struct {
 	// be established.  ConnectionTimeout is also used as the initial read timout
 	// for the AMQP connection handshake.
 	ConnectionTimeout time.Duration
+
+	// Dial, when set, is used by DialConfig to obtain the underlying
+	// transport connection in place of the default TCP dialer.  This allows
+	// connecting over a unix domain socket, tunneling through a SOCKS/HTTP
+	// proxy, or handing the handshake an in-memory net.Pipe for tests.  The
+	// returned net.Conn is wrapped the same as a dialed TCP socket, including
+	// TLS if TLSClientConfig is set.  Note that unlike the default dialer,
+	// a custom Dial is not bounded by the context passed to DialContext.
+	Dial func(network, addr string) (net.Conn, error)
+
+	// Locale specifies the locale that's expected to be returned by the
+	// server if the server provides a localized error message.  Dial sets
+	// this to "en_US".
+	Locale string
+
+	// Properties overrides entries in the ClientProperties table sent to
+	// the server in connection.start-ok (e.g. "product", "version",
+	// "capabilities").  Keys set here replace the library's defaults for
+	// those keys; all other defaults are preserved.
+	Properties Table
 }
 
 // Connection manages the serialization and deserialization of frames from IO
@@ -109,10 +132,15 @@ type Connection struct {
 
 	conn io.ReadWriteCloser
 
-	rpc       chan message
-	writer    *writer
-	sends     chan time.Time     // timestamps of each frame sent
-	deadlines chan readDeadliner // heartbeater updates read deadlines
+	role role // which side of the open-Connection handshake this Connection performs
+
+	rpc     chan message
+	writer  *writer
+	sends   chan time.Time       // timestamps of each frame sent
+	preface chan *protocolHeader // server role only: the client's protocol-header
+
+	lastRecv     int64 // unix nanos of the last frame read, set atomically by reader
+	readDeadline int64 // nanos to extend the read deadline by after each frame, set atomically by heartbeater
 
 	channels channelRegistry
 
@@ -133,6 +161,19 @@ type readDeadliner interface {
 	SetReadDeadline(time.Time) error
 }
 
+// role distinguishes which side of the open-Connection handshake a
+// Connection performs.  A client Connection (the zero value, used by
+// Dial/DialConfig/Open) sends protocol-header and connection.start-ok/
+// tune-ok/open.  A server Connection (used by Serve) waits for the
+// protocol-header and replies with connection.start/tune/open-ok, as a
+// broker would.
+type role int
+
+const (
+	roleClient role = iota
+	roleServer
+)
+
 // Dial accepts a string in the AMQP URI format and returns a new Connection
 // over TCP using PlainAuth.  Defaults to a server heartbeat interval of 10
 // seconds and sets the initial read deadline to 30 seconds.
@@ -164,6 +205,40 @@ func DialTLS(url string, amqps *tls.Config) (*Connection, error) {
 // a server heartbeat interval of 10 seconds and sets the initial read deadline
 // to 30 seconds.
 func DialConfig(url string, config Config) (*Connection, error) {
+	return DialConfigContext(context.Background(), url, config)
+}
+
+// DialContext accepts a string in the AMQP URI format and returns a new
+// Connection over TCP using PlainAuth.  Defaults to a server heartbeat
+// interval of 10 seconds and sets the initial read deadline to 30 seconds.
+//
+// DialContext is identical to Dial, except the TCP dial, the optional TLS
+// handshake, and the connection-open handshake (protocol-header through
+// connection.open-ok) all abort as soon as ctx is done, returning ctx.Err().
+// Use DialConfigContext to also override the tuning Config.
+//
+// Note: DialContext takes no Config, mirroring how Dial wraps DialConfig
+// with defaults; DialConfigContext is the (ctx, url, config) entry point
+// that mirrors DialConfig.  This is a deliberate split to match the
+// existing Dial/DialConfig pairing rather than a single context-aware
+// function taking both ctx and config.
+func DialContext(ctx context.Context, url string) (*Connection, error) {
+	return DialConfigContext(ctx, url, Config{
+		Heartbeat:         defaultHeartbeat,
+		ConnectionTimeout: defaultConnectionTimeout,
+	})
+}
+
+// DialConfigContext accepts a string in the AMQP URI format and a
+// configuration for the transport and connection setup, returning a new
+// Connection.
+//
+// It behaves like DialConfig, except ctx bounds the entire dial: the TCP
+// dial, the optional TLS handshake, and the connection-open handshake.  If
+// ctx is cancelled before connection.open-ok is received, the partially
+// opened connection is torn down and ctx.Err() is returned instead of
+// blocking until ConnectionTimeout or the server responds.
+func DialConfigContext(ctx context.Context, url string, config Config) (*Connection, error) {
 	var err error
 	var conn net.Conn
 
@@ -180,18 +255,40 @@ func DialConfig(url string, config Config) (*Connection, error) {
 		config.Vhost = uri.Vhost
 	}
 
+	if config.Locale == "" {
+		config.Locale = defaultLocale
+	}
+
 	if uri.Scheme == "amqps" && config.TLSClientConfig == nil {
 		config.TLSClientConfig = new(tls.Config)
 	}
 
 	addr := net.JoinHostPort(uri.Host, strconv.FormatInt(int64(uri.Port), 10))
 
-    s_conn, err := net.DialTimeout("tcp", addr, config.ConnectionTimeout)
+	dialCtx := ctx
+	if config.ConnectionTimeout > 0 {
+		var cancel context.CancelFunc
+		dialCtx, cancel = context.WithTimeout(ctx, config.ConnectionTimeout)
+		defer cancel()
+	}
+
+	dial := config.Dial
+	if dial == nil {
+		dialer := new(net.Dialer)
+		dial = func(network, addr string) (net.Conn, error) {
+			return dialer.DialContext(dialCtx, network, addr)
+		}
+	}
+
+	s_conn, err := dial("tcp", addr)
 	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
 		return nil, err
 	}
 
-    conn = NewTimeoutConn(s_conn, readWriteTimeout)
+	conn = NewTimeoutConn(s_conn, readWriteTimeout)
 
 	// Heartbeating hasn't started yet, don't stall forever on a dead server.
 	if err := conn.SetReadDeadline(time.Now().Add(config.ConnectionTimeout)); err != nil {
@@ -209,7 +306,7 @@ func DialConfig(url string, config Config) (*Connection, error) {
 		}
 
 		client := tls.Client(conn, config.TLSClientConfig)
-		if err := client.Handshake(); err != nil {
+		if err := client.HandshakeContext(dialCtx); err != nil {
 			conn.Close()
 			return nil, err
 		}
@@ -217,7 +314,7 @@ func DialConfig(url string, config Config) (*Connection, error) {
 		conn = client
 	}
 
-	return Open(conn, config)
+	return OpenContext(ctx, conn, config)
 }
 
 /*
@@ -227,17 +324,29 @@ to use your own custom transport.
 
 */
 func Open(conn io.ReadWriteCloser, config Config) (*Connection, error) {
+	return OpenContext(context.Background(), conn, config)
+}
+
+// OpenContext is identical to Open, except ctx bounds the connection-open
+// handshake (protocol-header through connection.open-ok).  If ctx is done
+// before the handshake completes, the Connection is shutdown with ctx.Err()
+// and that error is returned.
+func OpenContext(ctx context.Context, conn io.ReadWriteCloser, config Config) (*Connection, error) {
+	if config.Locale == "" {
+		config.Locale = defaultLocale
+	}
+
 	me := &Connection{
 		conn:      conn,
+		role:      roleClient,
 		writer:    &writer{bufio.NewWriter(conn)},
 		channels:  channelRegistry{channels: make(map[uint16]*Channel)},
 		rpc:       make(chan message),
 		sends:     make(chan time.Time),
 		errors:    make(chan *Error, 1),
-		deadlines: make(chan readDeadliner, 1),
 	}
 	go me.reader(conn)
-	return me, me.open(config)
+	return me, me.open(ctx, config)
 }
 
 /*
@@ -303,6 +412,7 @@ will also be closed.
 func (me *Connection) Close() error {
 	defer me.shutdown(nil)
 	return me.call(
+		context.Background(),
 		&connectionClose{
 			ReplyCode: replySuccess,
 			ReplyText: "kthxbai",
@@ -314,6 +424,7 @@ func (me *Connection) Close() error {
 func (me *Connection) closeWith(err *Error) error {
 	defer me.shutdown(err)
 	return me.call(
+		context.Background(),
 		&connectionClose{
 			ReplyCode: uint16(err.Code),
 			ReplyText: err.Reason,
@@ -414,6 +525,20 @@ func (me *Connection) dispatch0(f frame) {
 		}
 	case *heartbeatFrame:
 		// kthx - all reads reset our deadline.  so we can drop this
+	case *protocolHeader:
+		// only a server role expects to receive the client's preface; it is
+		// handed to openServerStart through a one-slot buffer, and a preface
+		// arriving while that slot is still full closes the connection.  A
+		// preface arriving after the slot was drained is not rejected.
+		if me.role == roleServer {
+			select {
+			case me.preface <- mf:
+			default:
+				me.closeWith(ErrUnexpectedFrame)
+			}
+		} else {
+			me.closeWith(ErrUnexpectedFrame)
+		}
 	default:
 		// lolwat - channel0 only responds to methods and heartbeats
 		me.closeWith(ErrUnexpectedFrame)
@@ -465,6 +590,8 @@ func (me *Connection) reader(r io.Reader) {
 	frames := &reader{buf}
 	conn, haveDeadliner := r.(readDeadliner)
 
+	atomic.StoreInt64(&me.lastRecv, time.Now().UnixNano())
+
 	for {
 		frame, err := frames.ReadFrame()
 
@@ -473,24 +600,35 @@ func (me *Connection) reader(r io.Reader) {
 			return
 		}
 
+		atomic.StoreInt64(&me.lastRecv, time.Now().UnixNano())
+
 		me.demux(frame)
 
 		if haveDeadliner {
-			me.deadlines <- conn
+			if d := atomic.LoadInt64(&me.readDeadline); d > 0 {
+				conn.SetReadDeadline(time.Now().Add(time.Duration(d)))
+			}
 		}
 	}
 }
 
-// Ensures that at least one frame is being sent at the tuned interval with a
-// jitter tolerance of 1s
-func (me *Connection) heartbeater(interval time.Duration, done chan *Error) {
-	const maxServerHeartbeatsInFlight = 3
+// missedHeartbeats is the number of heartbeat intervals §4.2.7 allows to
+// elapse with no inbound frame before the client must close the connection.
+const missedHeartbeats = 2
 
-	var sendTicks <-chan time.Time
-	if interval > 0 {
-		sendTicks = time.Tick(interval)
+// Sends a heartbeat at half the negotiated interval per §4.2.7, and closes
+// the connection if no frame - heartbeat or otherwise - has been read from
+// the server for two full intervals.
+func (me *Connection) heartbeater(interval time.Duration, done chan *Error) {
+	if interval <= 0 {
+		return
 	}
 
+	atomic.StoreInt64(&me.readDeadline, int64(missedHeartbeats*interval))
+
+	send := time.NewTicker(interval / 2)
+	defer send.Stop()
+
 	lastSent := time.Now()
 
 	for {
@@ -503,21 +641,24 @@ func (me *Connection) heartbeater(interval time.Duration, done chan *Error) {
 				return
 			}
 
-		case at := <-sendTicks:
+		case at := <-send.C:
 			// When idle, fill the space with a heartbeat frame
-			if at.Sub(lastSent) > interval-time.Second {
+			if at.Sub(lastSent) >= interval/2 {
 				if err := me.send(&heartbeatFrame{}); err != nil {
 					// send heartbeats even after close/closeOk so we
 					// tick until the connection starts erroring
 					return
 				}
+				lastSent = at
 			}
 
-		case conn := <-me.deadlines:
-			// When reading, reset our side of the deadline, if we've negotiated one with
-			// a deadline that covers at least 2 server heartbeats
-			if interval > 0 {
-				conn.SetReadDeadline(time.Now().Add(maxServerHeartbeatsInFlight * interval))
+			lastRecv := time.Unix(0, atomic.LoadInt64(&me.lastRecv))
+			if at.Sub(lastRecv) > missedHeartbeats*interval {
+				me.closeWith(&Error{
+					Code:   FrameError,
+					Reason: "missed heartbeats from server",
+				})
+				return
 			}
 
 		case <-done:
@@ -548,7 +689,7 @@ func (me *Connection) Channel() (*Channel, error) {
 	return channel, channel.open()
 }
 
-func (me *Connection) call(req message, res ...message) error {
+func (me *Connection) call(ctx context.Context, req message, res ...message) error {
 	// Special case for when the protocol header frame is sent insted of a
 	// request method
 	if req != nil {
@@ -558,6 +699,11 @@ func (me *Connection) call(req message, res ...message) error {
 	}
 
 	select {
+	case <-ctx.Done():
+		err := ctx.Err()
+		me.shutdown(&Error{Code: FrameError, Reason: err.Error()})
+		return err
+
 	case err := <-me.errors:
 		return err
 
@@ -588,18 +734,18 @@ func (me *Connection) call(req message, res ...message) error {
 //    use-Connection      = *channel
 //    close-Connection    = C:CLOSE S:CLOSE-OK
 //                        / S:CLOSE C:CLOSE-OK
-func (me *Connection) open(config Config) error {
+func (me *Connection) open(ctx context.Context, config Config) error {
 	if err := me.send(&protocolHeader{}); err != nil {
 		return err
 	}
 
-	return me.openStart(config)
+	return me.openStart(ctx, config)
 }
 
-func (me *Connection) openStart(config Config) error {
+func (me *Connection) openStart(ctx context.Context, config Config) error {
 	start := &connectionStart{}
 
-	if err := me.call(nil, start); err != nil {
+	if err := me.call(ctx, nil, start); err != nil {
 		return err
 	}
 
@@ -617,24 +763,22 @@ func (me *Connection) openStart(config Config) error {
 	// Save this mechanism off as the one we chose
 	me.Config.SASL = []Authentication{auth}
 
-	return me.openTune(config, auth)
+	return me.openTune(ctx, config, auth)
 }
 
-func (me *Connection) openTune(config Config, auth Authentication) error {
+func (me *Connection) openTune(ctx context.Context, config Config, auth Authentication) error {
 	ok := &connectionStartOk{
-		Mechanism: auth.Mechanism(),
-		Response:  auth.Response(),
-		ClientProperties: Table{ // Open an issue if you wish these refined/parameterizable
-			"product": "https://github.com/streadway/amqp",
-			"version": "β",
-			"capabilities": Table{
-				"connection.blocked": true,
-			},
-		},
+		Mechanism:        auth.Mechanism(),
+		Response:         auth.Response(),
+		Locale:           config.Locale,
+		ClientProperties: clientProperties(config.Properties),
 	}
 	tune := &connectionTune{}
 
-	if err := me.call(ok, tune); err != nil {
+	if err := me.call(ctx, ok, tune); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		// per spec, a connection can only be closed when it has been opened
 		// so at this point, we know it's an auth error, but the socket
 		// was closed instead.  Return a meaningful error.
@@ -671,14 +815,17 @@ func (me *Connection) openTune(config Config, auth Authentication) error {
 		return err
 	}
 
-	return me.openVhost(config)
+	return me.openVhost(ctx, config)
 }
 
-func (me *Connection) openVhost(config Config) error {
+func (me *Connection) openVhost(ctx context.Context, config Config) error {
 	req := &connectionOpen{VirtualHost: config.Vhost}
 	res := &connectionOpenOk{}
 
-	if err := me.call(req, res); err != nil {
+	if err := me.call(ctx, req, res); err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
 		// Cannot be closed yet, but we know it's a vhost problem
 		return ErrVhost
 	}
@@ -688,6 +835,26 @@ func (me *Connection) openVhost(config Config) error {
 	return nil
 }
 
+// clientProperties builds the ClientProperties table sent in
+// connection.start-ok, letting overrides replace individual default
+// entries (e.g. "product", "version", "capabilities") without losing the
+// rest.
+func clientProperties(overrides Table) Table {
+	props := Table{
+		"product": "https://github.com/streadway/amqp",
+		"version": "β",
+		"capabilities": Table{
+			"connection.blocked": true,
+		},
+	}
+
+	for k, v := range overrides {
+		props[k] = v
+	}
+
+	return props
+}
+
 func pick(client, server int) int {
 	if client == 0 || server == 0 {
 		// max
@@ -0,0 +1,163 @@
+// Copyright (c) 2012, Sean Treadway, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/streadway/amqp
+
+package amqp
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"time"
+)
+
+// accessRefused is the AMQP 0-9-1 connection.close reply code Serve sends
+// when a client's connection.start-ok fails authentication.
+const accessRefused = 403
+
+// Serve accepts an already established transport and runs the server side
+// of the connection-open handshake: it waits for the client's
+// protocol-header, emits connection.start, and replies to
+// connection.start-ok/tune-ok/open the way a broker would, instead of
+// sending them as a client.  Use this when a process has accepted a
+// connection rather than dialed one but still needs to speak AMQP on it,
+// such as the backchannel half of OpenMuxed/ServeMuxed (build tag "yamux",
+// see muxed_yamux.go).
+func Serve(conn io.ReadWriteCloser, config Config) (*Connection, error) {
+	return ServeContext(context.Background(), conn, config)
+}
+
+// ServeContext is identical to Serve, except ctx bounds the server side of
+// the open handshake the same way OpenContext bounds the client side.
+func ServeContext(ctx context.Context, conn io.ReadWriteCloser, config Config) (*Connection, error) {
+	if config.Locale == "" {
+		config.Locale = defaultLocale
+	}
+
+	me := &Connection{
+		conn:      conn,
+		role:      roleServer,
+		writer:    &writer{bufio.NewWriter(conn)},
+		channels:  channelRegistry{channels: make(map[uint16]*Channel)},
+		rpc:       make(chan message),
+		sends:     make(chan time.Time),
+		errors:    make(chan *Error, 1),
+		preface:   make(chan *protocolHeader, 1),
+	}
+	go me.reader(conn)
+	return me, me.openServerStart(ctx, config)
+}
+
+// Mirror of open/openStart/openTune/openVhost, but for the server role:
+// where the client half sends a request and waits for the matching
+// response, the server half waits for the matching request and sends the
+// response, using the same call() plumbing in both directions since
+// dispatch0 forwards any unmatched channel-0 method onto rpc regardless of
+// role.
+func (me *Connection) openServerStart(ctx context.Context, config Config) error {
+	select {
+	case <-ctx.Done():
+		err := ctx.Err()
+		me.shutdown(&Error{Code: FrameError, Reason: err.Error()})
+		return err
+	case err := <-me.errors:
+		return err
+	case <-me.preface:
+	}
+
+	if err := me.send(&methodFrame{
+		ChannelId: 0,
+		Method: &connectionStart{
+			VersionMajor:     0,
+			VersionMinor:     9,
+			ServerProperties: clientProperties(config.Properties),
+			Mechanisms:       "PLAIN",
+			Locales:          config.Locale,
+		},
+	}); err != nil {
+		return err
+	}
+
+	startOk := &connectionStartOk{}
+	if err := me.call(ctx, nil, startOk); err != nil {
+		return err
+	}
+
+	if err := me.authenticate(config, startOk); err != nil {
+		me.send(&methodFrame{
+			ChannelId: 0,
+			Method: &connectionClose{
+				ReplyCode: uint16(err.Code),
+				ReplyText: err.Reason,
+			},
+		})
+		me.shutdown(err)
+		return err
+	}
+
+	return me.openServerTune(ctx, config, startOk)
+}
+
+// authenticate checks the client's connection.start-ok against
+// config.SASL, the same Authentication values DialConfig would have used
+// to produce that mechanism/response pair as a client.
+//
+// If config.SASL is empty, Serve performs no authentication at all and
+// accepts any client - it must only be run over a transport that is
+// already trusted (e.g. the backchannel half of OpenMuxed/ServeMuxed,
+// where the forward Connection already authenticated the peer).
+func (me *Connection) authenticate(config Config, startOk *connectionStartOk) *Error {
+	if len(config.SASL) == 0 {
+		return nil
+	}
+
+	for _, auth := range config.SASL {
+		if auth.Mechanism() == startOk.Mechanism && auth.Response() == startOk.Response {
+			return nil
+		}
+	}
+
+	return newError(accessRefused, "ACCESS_REFUSED - login was refused")
+}
+
+func (me *Connection) openServerTune(ctx context.Context, config Config, startOk *connectionStartOk) error {
+	if err := me.send(&methodFrame{
+		ChannelId: 0,
+		Method: &connectionTune{
+			ChannelMax: uint16(config.Channels),
+			FrameMax:   uint32(config.FrameSize),
+			Heartbeat:  uint16(config.Heartbeat / time.Second),
+		},
+	}); err != nil {
+		return err
+	}
+
+	tuneOk := &connectionTuneOk{}
+	if err := me.call(ctx, nil, tuneOk); err != nil {
+		return err
+	}
+
+	me.Config.Channels = pick(config.Channels, int(tuneOk.ChannelMax))
+	me.Config.FrameSize = pick(config.FrameSize, int(tuneOk.FrameMax))
+	me.Config.Heartbeat = time.Second * time.Duration(pick(
+		int(config.Heartbeat/time.Second), int(tuneOk.Heartbeat)))
+
+	go me.heartbeater(me.Config.Heartbeat, me.NotifyClose(make(chan *Error, 1)))
+
+	return me.openServerVhost(ctx, config)
+}
+
+func (me *Connection) openServerVhost(ctx context.Context, config Config) error {
+	open := &connectionOpen{}
+	if err := me.call(ctx, nil, open); err != nil {
+		return err
+	}
+
+	me.Config.Vhost = open.VirtualHost
+
+	return me.send(&methodFrame{
+		ChannelId: 0,
+		Method:    &connectionOpenOk{},
+	})
+}
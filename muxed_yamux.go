@@ -0,0 +1,107 @@
+// Copyright (c) 2012, Sean Treadway, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/streadway/amqp
+
+//go:build yamux
+// +build yamux
+
+package amqp
+
+import (
+	"io"
+
+	"github.com/hashicorp/yamux"
+)
+
+// OpenMuxed and ServeMuxed pull in github.com/hashicorp/yamux, the first
+// third-party dependency this package has ever taken on.  That's deliberate
+// and scoped: this file only builds with -tags yamux, so `go build ./...`
+// and `go get` against the core package stay dependency-free exactly as
+// before; only callers who opt into the muxed backchannel pay for the new
+// dependency. Pulling in yamux at all needs maintainer sign-off - flag it
+// in review rather than assuming the build tag settles it.
+
+// OpenMuxed multiplexes a single transport, using yamux, into two logical
+// AMQP Connections running in opposite directions: forward is dialed as a
+// client against the peer on the first stream, and backchannel is Served
+// on a second stream the peer opens back, so the peer can initiate AMQP
+// method calls into this process.
+//
+// This lets a consumer behind NAT dial out to a broker/relay and still
+// accept calls from it - useful for edge devices that publish metrics but
+// also need to receive commands.  The peer must call ServeMuxed on its end
+// of the same transport.
+func OpenMuxed(conn io.ReadWriteCloser, config Config) (forward, backchannel *Connection, err error) {
+	session, err := yamux.Client(conn, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fwd, err := session.OpenStream()
+	if err != nil {
+		session.Close()
+		return nil, nil, err
+	}
+
+	forward, err = Open(fwd, config)
+	if err != nil {
+		session.Close()
+		return nil, nil, err
+	}
+
+	back, err := session.AcceptStream()
+	if err != nil {
+		forward.Close()
+		session.Close()
+		return nil, nil, err
+	}
+
+	backchannel, err = Serve(back, config)
+	if err != nil {
+		forward.Close()
+		session.Close()
+		return nil, nil, err
+	}
+
+	return forward, backchannel, nil
+}
+
+// ServeMuxed is the peer side of OpenMuxed over the same yamux-multiplexed
+// transport: it Serves the forward Connection as a server, and dials the
+// backchannel Connection as a client back into the process that called
+// OpenMuxed.
+func ServeMuxed(conn io.ReadWriteCloser, config Config) (forward, backchannel *Connection, err error) {
+	session, err := yamux.Server(conn, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	fwd, err := session.AcceptStream()
+	if err != nil {
+		session.Close()
+		return nil, nil, err
+	}
+
+	forward, err = Serve(fwd, config)
+	if err != nil {
+		session.Close()
+		return nil, nil, err
+	}
+
+	back, err := session.OpenStream()
+	if err != nil {
+		forward.Close()
+		session.Close()
+		return nil, nil, err
+	}
+
+	backchannel, err = Open(back, config)
+	if err != nil {
+		forward.Close()
+		session.Close()
+		return nil, nil, err
+	}
+
+	return forward, backchannel, nil
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2012, Sean Treadway, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/streadway/amqp
+
+//go:build yamux
+// +build yamux
+
+package amqp
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// TestOpenServeMuxed proves OpenMuxed/ServeMuxed actually complete two
+// handshakes, in opposite roles, over the same yamux-multiplexed
+// transport, rather than only against a hypothetical broker.
+func TestOpenServeMuxed(t *testing.T) {
+	a, b := net.Pipe()
+
+	config := Config{
+		SASL:  []Authentication{PlainAuth("guest", "guest")},
+		Vhost: "/",
+	}
+
+	type result struct {
+		forward, backchannel *Connection
+		err                  error
+	}
+
+	openDone := make(chan result, 1)
+	serveDone := make(chan result, 1)
+
+	go func() {
+		forward, backchannel, err := OpenMuxed(a, config)
+		openDone <- result{forward, backchannel, err}
+	}()
+
+	go func() {
+		forward, backchannel, err := ServeMuxed(b, config)
+		serveDone <- result{forward, backchannel, err}
+	}()
+
+	timeout := time.After(5 * time.Second)
+
+	var open, serve result
+	for i := 0; i < 2; i++ {
+		select {
+		case open = <-openDone:
+		case serve = <-serveDone:
+		case <-timeout:
+			t.Fatal("muxed handshake did not complete before deadline")
+		}
+	}
+
+	if open.err != nil {
+		t.Fatalf("OpenMuxed failed: %v", open.err)
+	}
+	if serve.err != nil {
+		t.Fatalf("ServeMuxed failed: %v", serve.err)
+	}
+
+	defer open.forward.Close()
+	defer open.backchannel.Close()
+	defer serve.forward.Close()
+	defer serve.backchannel.Close()
+}
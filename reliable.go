@@ -0,0 +1,558 @@
+// Copyright (c) 2012, Sean Treadway, SoundCloud Ltd.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+// Source code and contact info at http://github.com/streadway/amqp
+
+package amqp
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Reconnected is sent on the channels registered with
+// ReliableConnection.NotifyReconnect after the transport has been redialed
+// and every recorded Channel's topology has been replayed.  Receivers
+// should use this to rebuild state that does not survive a redial, such as
+// re-issuing confirm.select.
+type Reconnected struct {
+	Attempt int // number of redials that preceded this event, starting at 1
+}
+
+// ReliableConfig tunes the backoff ReliableConnection uses between redial
+// attempts after the transport closes unexpectedly.
+type ReliableConfig struct {
+	// InitialInterval is the delay before the first redial attempt.
+	// Defaults to 500ms.
+	InitialInterval time.Duration
+
+	// MaxInterval caps the backoff delay between attempts.  Defaults to
+	// 30s.
+	MaxInterval time.Duration
+
+	// Multiplier scales the prior delay on every failed attempt, up to
+	// MaxInterval.  Defaults to 2.  A Multiplier of 1 disables growth.
+	Multiplier float64
+
+	// Jitter is the fraction (0..1) of the computed delay that is
+	// randomized, to avoid many clients reconnecting in lockstep after a
+	// broker restart.  Values outside 0..1 are replaced with 0.2; 0
+	// disables jitter.
+	Jitter float64
+
+	// MaxAttempts bounds the number of consecutive failed redials before
+	// ReliableConnection gives up and permanently closes.  0 means retry
+	// forever.
+	MaxAttempts int
+}
+
+func (rc ReliableConfig) withDefaults() ReliableConfig {
+	if rc.InitialInterval <= 0 {
+		rc.InitialInterval = 500 * time.Millisecond
+	}
+	if rc.MaxInterval <= 0 {
+		rc.MaxInterval = 30 * time.Second
+	}
+	if rc.Multiplier < 1 {
+		rc.Multiplier = 2
+	}
+	if rc.Jitter < 0 || rc.Jitter > 1 {
+		rc.Jitter = 0.2
+	}
+	return rc
+}
+
+// delay returns the backoff for the given attempt number, attempt 1 being
+// the first redial following a close.
+func (rc ReliableConfig) delay(attempt int) time.Duration {
+	d := float64(rc.InitialInterval)
+	for i := 1; i < attempt; i++ {
+		d *= rc.Multiplier
+		if d >= float64(rc.MaxInterval) {
+			d = float64(rc.MaxInterval)
+			break
+		}
+	}
+
+	if rc.Jitter > 0 {
+		d += d * rc.Jitter * (rand.Float64()*2 - 1)
+	}
+	if d < 0 {
+		d = 0
+	}
+
+	return time.Duration(d)
+}
+
+/*
+ReliableConnection wraps a Connection and transparently redials using a
+backoff whenever the transport is closed for a reason other than a call to
+Close.  Every ReliableChannel opened through it records the exchange and
+queue declarations, bindings, Qos and Consume calls issued on it, and
+replays them against a freshly opened Channel after each redial, so
+applications don't need to re-run their setup after every broker restart.
+
+Use DialReliable in place of Dial or DialConfig to obtain one.
+*/
+type ReliableConnection struct {
+	url    string
+	config Config
+	backoff ReliableConfig
+
+	m          sync.Mutex
+	conn       *Connection
+	channels   []*ReliableChannel
+	reconnects []chan Reconnected
+	closed     bool
+}
+
+// DialReliable accepts a string in the AMQP URI format and a Config exactly
+// like DialConfig, plus a ReliableConfig controlling redial backoff.  The
+// returned ReliableConnection redials automatically until Close is called
+// or ReliableConfig.MaxAttempts consecutive redials have failed.
+func DialReliable(url string, config Config, backoff ReliableConfig) (*ReliableConnection, error) {
+	conn, err := DialConfig(url, config)
+	if err != nil {
+		return nil, err
+	}
+
+	rc := &ReliableConnection{
+		url:     url,
+		config:  config,
+		backoff: backoff.withDefaults(),
+		conn:    conn,
+	}
+
+	go rc.watch(conn)
+
+	return rc, nil
+}
+
+func (rc *ReliableConnection) current() *Connection {
+	rc.m.Lock()
+	defer rc.m.Unlock()
+	return rc.conn
+}
+
+/*
+NotifyReconnect registers a listener that receives a Reconnected event after
+every successful redial and topology replay.  Use this to rebuild ephemeral
+state that a redial doesn't restore on its own, such as re-issuing
+confirm.select on a publisher Channel.
+
+If the ReliableConnection is already closed, c is closed immediately.
+*/
+func (rc *ReliableConnection) NotifyReconnect(c chan Reconnected) chan Reconnected {
+	rc.m.Lock()
+	defer rc.m.Unlock()
+
+	if rc.closed {
+		close(c)
+	} else {
+		rc.reconnects = append(rc.reconnects, c)
+	}
+
+	return c
+}
+
+// Channel opens a new ReliableChannel on the current underlying Connection.
+// Declarations, bindings, Qos and Consume calls issued through the returned
+// ReliableChannel are recorded and replayed on the Channel opened against
+// each subsequent redial.
+func (rc *ReliableConnection) Channel() (*ReliableChannel, error) {
+	conn := rc.current()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+
+	rch := &ReliableChannel{rc: rc, ch: ch}
+
+	rc.m.Lock()
+	rc.channels = append(rc.channels, rch)
+	rc.m.Unlock()
+
+	return rch, nil
+}
+
+// Close permanently closes the ReliableConnection.  No further redial is
+// attempted and every channel registered with NotifyReconnect is closed.
+func (rc *ReliableConnection) Close() error {
+	rc.m.Lock()
+	rc.closed = true
+	conn := rc.conn
+	channels := append([]*ReliableChannel(nil), rc.channels...)
+	for _, c := range rc.reconnects {
+		close(c)
+	}
+	rc.m.Unlock()
+
+	for _, rch := range channels {
+		rch.closeConsumers()
+	}
+
+	return conn.Close()
+}
+
+// watch waits for the current Connection to close unexpectedly and kicks
+// off a redial loop.  A nil error on the close channel, or the channel
+// being closed without a value, means Close was called and no redial
+// should happen.
+func (rc *ReliableConnection) watch(conn *Connection) {
+	err, ok := <-conn.NotifyClose(make(chan *Error, 1))
+	if !ok || err == nil {
+		return
+	}
+
+	rc.m.Lock()
+	closed := rc.closed
+	rc.m.Unlock()
+	if closed {
+		return
+	}
+
+	rc.redial(1)
+}
+
+func (rc *ReliableConnection) redial(attempt int) {
+	for {
+		rc.m.Lock()
+		closed := rc.closed
+		rc.m.Unlock()
+		if closed {
+			return
+		}
+
+		if rc.backoff.MaxAttempts > 0 && attempt > rc.backoff.MaxAttempts {
+			rc.fail()
+			return
+		}
+
+		time.Sleep(rc.backoff.delay(attempt))
+
+		conn, err := rc.reconnectOnce()
+		if err != nil {
+			attempt++
+			continue
+		}
+
+		rc.m.Lock()
+		if rc.closed {
+			rc.m.Unlock()
+			conn.Close()
+			return
+		}
+		rc.conn = conn
+		listeners := append([]chan Reconnected(nil), rc.reconnects...)
+		rc.m.Unlock()
+
+		for _, c := range listeners {
+			select {
+			case c <- Reconnected{Attempt: attempt}:
+			default:
+			}
+		}
+
+		go rc.watch(conn)
+		return
+	}
+}
+
+// reconnectOnce dials a single fresh Connection and replays every open
+// ReliableChannel's recorded topology against it.  On any failure the new
+// Connection is torn down so the caller can retry with backoff.
+func (rc *ReliableConnection) reconnectOnce() (*Connection, error) {
+	conn, err := DialConfig(rc.url, rc.config)
+	if err != nil {
+		return nil, err
+	}
+
+	rc.m.Lock()
+	channels := append([]*ReliableChannel(nil), rc.channels...)
+	rc.m.Unlock()
+
+	for _, rch := range channels {
+		if err := rch.reopen(conn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	return conn, nil
+}
+
+func (rc *ReliableConnection) fail() {
+	rc.m.Lock()
+	rc.closed = true
+	channels := append([]*ReliableChannel(nil), rc.channels...)
+	for _, c := range rc.reconnects {
+		close(c)
+	}
+	rc.m.Unlock()
+
+	for _, rch := range channels {
+		rch.closeConsumers()
+	}
+}
+
+type topologyExchange struct {
+	name, kind                             string
+	durable, autoDelete, internal, noWait bool
+	args                                    Table
+}
+
+type topologyQueue struct {
+	name                                   string
+	durable, autoDelete, exclusive, noWait bool
+	args                                    Table
+}
+
+type topologyBinding struct {
+	queue, exchange, key string
+	noWait                bool
+	args                  Table
+}
+
+type topologyQos struct {
+	prefetchCount, prefetchSize int
+	global                      bool
+}
+
+type topologyConsumer struct {
+	queue, consumer                     string
+	autoAck, exclusive, noLocal, noWait bool
+	args                                 Table
+	out                                  chan Delivery
+	done                                 chan struct{}
+	closeOnce                           sync.Once
+}
+
+// requestClose signals the active pumpDeliveries goroutine for this
+// consumer to stop forwarding and close out itself, exactly once.  Closing
+// out here directly would race a pumpDeliveries blocked on `c.out <- d`;
+// only pumpDeliveries may close out, so this only closes done.
+func (c *topologyConsumer) requestClose() {
+	c.closeOnce.Do(func() { close(c.done) })
+}
+
+/*
+ReliableChannel decorates a Channel, recording the exchange and queue
+declarations, bindings, Qos and Consume calls issued through it so its
+owning ReliableConnection can replay them against a new Channel every time
+the transport is redialed.  Deliveries returned from Consume keep arriving
+on the same Go channel across a redial; the ReliableChannel re-issues
+Consume against the fresh server-side channel and pipes new deliveries
+into it.
+*/
+type ReliableChannel struct {
+	rc *ReliableConnection
+
+	m sync.Mutex
+	ch *Channel
+
+	topology sync.Mutex // guards the fields below
+	exchanges []topologyExchange
+	queues    []topologyQueue
+	bindings  []topologyBinding
+	qos       *topologyQos
+	consumers []*topologyConsumer
+}
+
+func (rch *ReliableChannel) current() *Channel {
+	rch.m.Lock()
+	defer rch.m.Unlock()
+	return rch.ch
+}
+
+// closeConsumers asks every consumer's pumpDeliveries goroutine recorded on
+// this ReliableChannel to stop and close its delivery channel.  Called by
+// the owning ReliableConnection as it permanently shuts down, so callers
+// ranging over a Consume channel see it close instead of blocking forever.
+func (rch *ReliableChannel) closeConsumers() {
+	rch.topology.Lock()
+	defer rch.topology.Unlock()
+
+	for _, c := range rch.consumers {
+		c.requestClose()
+	}
+}
+
+// ExchangeDeclare records and forwards an exchange declaration.
+func (rch *ReliableChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args Table) error {
+	rch.topology.Lock()
+	rch.exchanges = append(rch.exchanges, topologyExchange{name, kind, durable, autoDelete, internal, noWait, args})
+	rch.topology.Unlock()
+
+	return rch.current().ExchangeDeclare(name, kind, durable, autoDelete, internal, noWait, args)
+}
+
+// QueueDeclare records and forwards a queue declaration.
+func (rch *ReliableChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args Table) (Queue, error) {
+	rch.topology.Lock()
+	rch.queues = append(rch.queues, topologyQueue{name, durable, autoDelete, exclusive, noWait, args})
+	rch.topology.Unlock()
+
+	return rch.current().QueueDeclare(name, durable, autoDelete, exclusive, noWait, args)
+}
+
+// QueueBind records and forwards a queue binding.
+func (rch *ReliableChannel) QueueBind(name, key, exchange string, noWait bool, args Table) error {
+	rch.topology.Lock()
+	rch.bindings = append(rch.bindings, topologyBinding{name, exchange, key, noWait, args})
+	rch.topology.Unlock()
+
+	return rch.current().QueueBind(name, key, exchange, noWait, args)
+}
+
+// Qos records and forwards the prefetch settings for this channel.
+func (rch *ReliableChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	rch.topology.Lock()
+	rch.qos = &topologyQos{prefetchCount, prefetchSize, global}
+	rch.topology.Unlock()
+
+	return rch.current().Qos(prefetchCount, prefetchSize, global)
+}
+
+// Consume records the consumer and returns a Delivery channel that keeps
+// receiving deliveries across redials: on reconnect, basic.consume is
+// re-issued with the same queue and consumer tag and fed into the same
+// returned channel.
+func (rch *ReliableChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args Table) (<-chan Delivery, error) {
+	deliveries, err := rch.current().Consume(queue, consumer, autoAck, exclusive, noLocal, noWait, args)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(chan Delivery)
+	c := &topologyConsumer{queue: queue, consumer: consumer, autoAck: autoAck, exclusive: exclusive, noLocal: noLocal, noWait: noWait, args: args, out: out, done: make(chan struct{})}
+
+	rch.topology.Lock()
+	rch.consumers = append(rch.consumers, c)
+	rch.topology.Unlock()
+
+	go pumpDeliveries(rch.rc, deliveries, c)
+
+	return out, nil
+}
+
+// Publish forwards to the Channel opened against the current Connection.
+// A Publish racing a redial transparently rebinds: on error, it waits for
+// the next successful redial and retries against the freshly reopened
+// Channel, rather than handing the caller a transient error to retry
+// itself.
+//
+// ReliableConnection has no context of its own - unlike the ctx threaded
+// through the handshake in OpenContext/DialConfigContext, Close is its
+// only cancellation signal - so Publish only gives up and returns
+// ErrClosed once the ReliableConnection is permanently closed, whether
+// because Close was called or because ReliableConfig.MaxAttempts
+// consecutive redials failed.
+//
+// Each retry registers a one-shot NotifyReconnect listener; a Publish that
+// fails repeatedly across many redials accumulates one per attempt on
+// ReliableConnection.reconnects for the life of the ReliableConnection.
+func (rch *ReliableChannel) Publish(exchange, key string, mandatory, immediate bool, msg Publishing) error {
+	for {
+		if err := rch.current().Publish(exchange, key, mandatory, immediate, msg); err == nil {
+			return nil
+		}
+
+		reconnected := rch.rc.NotifyReconnect(make(chan Reconnected, 1))
+		if _, ok := <-reconnected; !ok {
+			return ErrClosed
+		}
+	}
+}
+
+// reopen opens a fresh Channel against conn and replays this
+// ReliableChannel's recorded topology onto it, swapping it in only once
+// every recorded call has succeeded.
+func (rch *ReliableChannel) reopen(conn *Connection) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return err
+	}
+
+	rch.topology.Lock()
+	defer rch.topology.Unlock()
+
+	for _, e := range rch.exchanges {
+		if err := ch.ExchangeDeclare(e.name, e.kind, e.durable, e.autoDelete, e.internal, e.noWait, e.args); err != nil {
+			return err
+		}
+	}
+
+	for _, q := range rch.queues {
+		if _, err := ch.QueueDeclare(q.name, q.durable, q.autoDelete, q.exclusive, q.noWait, q.args); err != nil {
+			return err
+		}
+	}
+
+	for _, b := range rch.bindings {
+		if err := ch.QueueBind(b.queue, b.key, b.exchange, b.noWait, b.args); err != nil {
+			return err
+		}
+	}
+
+	if rch.qos != nil {
+		if err := ch.Qos(rch.qos.prefetchCount, rch.qos.prefetchSize, rch.qos.global); err != nil {
+			return err
+		}
+	}
+
+	for _, c := range rch.consumers {
+		deliveries, err := ch.Consume(c.queue, c.consumer, c.autoAck, c.exclusive, c.noLocal, c.noWait, c.args)
+		if err != nil {
+			return err
+		}
+		go pumpDeliveries(rch.rc, deliveries, c)
+	}
+
+	rch.m.Lock()
+	rch.ch = ch
+	rch.m.Unlock()
+
+	return nil
+}
+
+// pumpDeliveries forwards deliveries from a single Consume call into the
+// long-lived channel returned to the caller.  It is the sole closer of
+// c.out, so a blocked `c.out <- d` can never race a close from elsewhere:
+// requestClose only closes c.done, which this select observes instead of
+// sending.
+//
+// When the upstream channel closes, either the Channel was reopened under
+// a redial - in which case a new pump takes over and out is left open - or
+// the ReliableConnection was permanently closed, in which case out is
+// closed so a caller ranging over it observes the close instead of
+// blocking forever.
+func pumpDeliveries(rc *ReliableConnection, in <-chan Delivery, c *topologyConsumer) {
+	for {
+		select {
+		case d, ok := <-in:
+			if !ok {
+				rc.m.Lock()
+				closed := rc.closed
+				rc.m.Unlock()
+
+				if closed {
+					close(c.out)
+				}
+				return
+			}
+
+			select {
+			case c.out <- d:
+			case <-c.done:
+				close(c.out)
+				return
+			}
+
+		case <-c.done:
+			close(c.out)
+			return
+		}
+	}
+}